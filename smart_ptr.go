@@ -1,7 +1,7 @@
 package main
 
 import (
-	"fmt"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"unsafe"
@@ -12,174 +12,431 @@ import (
 // as short as a HTTP request, as short as a TCP connection.
 // However, this patten works perfectly in languages having an idea of thread-pool, like cpp and Java. In such
 // language, a thread is long living and might serve many requests.
+//
+// Update: the local cache below is no longer keyed by a goroutine-allocated ID. Goroutines come and go, so an
+// identity a goroutine must request once and hold forever doesn't fit; instead we shard the cache by P, the same
+// trick sync.Pool uses, since the number of Ps is small, fixed by GOMAXPROCS, and a goroutine always runs on some P
+// whenever it actually touches the cache.
 
-// ImmRscPtr is used to safely and efficently share a mult-version immutable resource that needs to be cleaned up
-// whenever not used by anyone (e.g. a snapshot in DB) across multiple goroutines. It has the following features:
+// MVPtr[T] safely and efficently shares a mult-version immutable value that needs to be cleaned up whenever not
+// used by anyone (e.g. a snapshot in DB, a compiled regex, a routing table) across multiple goroutines. It has
+// the following features:
+//
+// (1) If the call of Store() in a writer happens-before the call of Load() in a reader then the reader sees
+// what the writer put in, except that the first Load() on a P after the Store() may return, once, the version
+// that P had cached before it (from the P's retire slot, see Load).
+// (2) If the value has not changed since the last Load() on the calling goroutine's P, Load() has a cost of
+// only a handful of atomic operations.
+// (3) As long as the caller of Load() calls Release() on the returned *Snapshot[T], the value behind an old
+// Snapshot is never leaked: its deleter runs exactly once, after the last Release().
 //
-// (1) If the call of UpdateResource() in a writer happens-before the call of GetResource() in a reader
-// then the reader sees what the writer puts in.
-// (2) If the ImmutableResource has not been changed since the last GetResource(), then GetResource() has a cost
-// of only two atomic operations.
-// (3) As long as the caller of GetResource() manages to call Unref() on the returning ImmRscPtr, then no ImmutableResource
-// will be leaked. By saying leaked, we means that Delete() is never be called on an obsolute ImmutableResource even
-// there is no one using it.
-// (3) As long as the caller of GetResource() does not call Unref() on the returning ImmRscPtr, then it will
-// not be Delete() even it becomes obsolute
+// Each per-P cache (see pLocalInternal) holds at most two live versions at a time, "current" and "retire": every
+// Store() ages the previous retire slot out (Unref()'ing whatever was there) before installing whatever this P's
+// current slot held as the new one, so a victim never survives more than one Store() cycle even on a P that sat
+// idle across several of them.
+//
+// Unlike the package-level API this type replaces, an *MVPtr[T] is not a singleton: callers instantiate as many
+// independent ones as they need via NewMVPtr, each with its own per-P shard array, and Delete() is no longer
+// part of an interface contract — T can be any type, cleaned up (if at all) by the deleter closure passed to
+// Store().
+type MVPtr[T any] struct {
+	// latest is the published root: readers Load() it lock-free. Store() publishes a new version with a single
+	// atomic Swap and walks the per-P slots to retire the superseded one — no mutex on either the publish or
+	// the read path.
+	latest atomic.Pointer[immRscHandle[T]]
+
+	// rootRetire holds the previous root handle for one extra Store() cycle before it is actually Unref()'d,
+	// mirroring the per-P retire slot below: a reader that Load()'d latest a moment before it was swapped but
+	// hasn't taken its own ref on it yet is a brief hazard, and giving that handle a full cycle of grace before
+	// we drop our own reference is enough time for any such in-flight Load()+Ref() to complete in practice.
+	//
+	// This is deliberately a refcount-driven approximation, not gated on RCU quiescence: an earlier version of
+	// this field paired the handle with its retirement generation and made the Unref() below wait on
+	// waitForQuiescence, on the theory that this would actually prove no in-flight reader survives rather than
+	// just bound it. In practice that gate can never be satisfied once any P anywhere has gone idle without ever
+	// registering a read on this MVPtr, so it traded a narrow, already-rare race for a guaranteed leak:
+	// GOMAXPROCS=4 with a single reader and a handful of Stores was enough to leave every superseded version
+	// unreclaimed and leak one blocked goroutine per Store. Root-miss reads (see Load) are rare by construction
+	// (they only happen when both per-P slots miss), so the refcount-only approximation is the right tradeoff.
+	rootRetire atomic.Pointer[immRscHandle[T]]
+
+	pLocals     unsafe.Pointer // *[N]pLocalPad[T], allocated lazily and grown as GOMAXPROCS grows
+	pLocalsSize int32          // len of the array pLocals points to
+	pLocalsMu   sync.Mutex     // guards (re)allocating pLocals; the hot path never takes it
+
+	kInuse *immRscHandle[T] // sentinel marking a slot as currently checked out by a reader
+
+	// rcuGeneration, together with rcuEpochs, implements the second, RCU-flavoured access mode (RcuRead /
+	// RcuQuiescent): a monotonically increasing counter bumped once per Store(). See the doc comment on
+	// RcuRead for the rest of the scheme.
+	rcuGeneration uint64
 
-type ImmutableResource interface {
-	Delete()
+	rcuEpochs     unsafe.Pointer // *[N]pEpochPad, allocated lazily and grown as GOMAXPROCS grows
+	rcuEpochsSize int32          // len of the array rcuEpochs points to
+	rcuEpochsMu   sync.Mutex     // guards (re)allocating rcuEpochs
 }
 
-var maxGID int32 = -1
-var gLocalImmRscHandles [1024]*ImmRscHandle
-var kInuse *ImmRscHandle = newImmRscHandle(nil)
+// NewMVPtr creates an MVPtr holding the zero value of T with no deleter. Call Store to publish a real value.
+func NewMVPtr[T any]() *MVPtr[T] {
+	p := &MVPtr[T]{kInuse: &immRscHandle[T]{}}
+	var zero T
+	p.latest.Store(newImmRscHandle(zero, nil))
+	return p
+}
 
+// Snapshot is a reference-counted handle on one version of T. Callers must call Release() exactly once to
+// release their ownership.
+type Snapshot[T any] struct {
+	h *immRscHandle[T]
+}
 
-func atomicSwapGLocalImmRscHandle(gID int32, new *ImmRscHandle) *ImmRscHandle {
-	gLocalImmRscHandles[gID] = new
-	return (*ImmRscHandle)(atomic.SwapPointer((*unsafe.Pointer)((unsafe.Pointer)(&gLocalImmRscHandles[gID])), unsafe.Pointer(new)))
+// Value returns the version of T this Snapshot was taken from. It remains valid until Release() is called.
+func (s *Snapshot[T]) Value() T {
+	return s.h.value
 }
-func atomicCmpAndSwapGLocalImmRscHandles(gID int32, old, new *ImmRscHandle) bool {
-	if old == gLocalImmRscHandles[gID] {
-		gLocalImmRscHandles[gID] = new
-		return true
-	}
-	return atomic.CompareAndSwapPointer((*unsafe.Pointer)((unsafe.Pointer)(&gLocalImmRscHandles[gID])), unsafe.Pointer(old), unsafe.Pointer(new))
+
+// Release gives up this Snapshot's ownership. Once the last outstanding Snapshot on a version is released, its
+// deleter (as passed to the Store() call that published it) runs.
+func (s *Snapshot[T]) Release() {
+	s.h.Unref()
+}
+
+// runtime_procPin/runtime_procUnpin pin the calling goroutine to its current P, preventing it from being
+// rescheduled elsewhere for the duration of the pin, and return the P's id. sync.Pool links against the very
+// same runtime symbols to shard its per-P pools; we borrow the trick here.
+//
+//go:linkname runtime_procPin sync.runtime_procPin
+func runtime_procPin() int
+
+//go:linkname runtime_procUnpin sync.runtime_procUnpin
+func runtime_procUnpin()
+
+// pLocalInternal is the per-P cache slot. `current` is swapped atomically against kInuse while a reader is
+// using it. `retire` is a one-deep slot that Store() pushes the superseded handle into directly — a miniature
+// two-entry queue in the spirit of sync.poolDequeue, just sized for exactly the two roles we need ("current"
+// and "pending retire") rather than poolDequeue's general head/tail-indexed ring, which would be solving a
+// problem we don't have here.
+type pLocalInternal[T any] struct {
+	current *immRscHandle[T]
+	retire  *immRscHandle[T]
 }
 
+// pLocalPad pads pLocalInternal out to 128 bytes, the size of two cache lines on most platforms we run on, so
+// that two Ps hammering adjacent slots don't false-share a cache line. The pad size is a literal rather than
+// unsafe.Sizeof(pLocalInternal[T]{}): an array length must be a constant, and the compiler won't fold
+// unsafe.Sizeof of a type that still carries a type parameter into one. It's safe to hardcode anyway, since
+// pLocalInternal only ever holds two pointers regardless of T.
+type pLocalPad[T any] struct {
+	pLocalInternal[T]
+	pad [112]byte
+}
 
-// each goroutine can call this function at most once
-func AllocateGLocalImmRscHandle() int32 {
-	newId := atomic.AddInt32(&maxGID, 1) // goroutine id starts from 0
-	gLocalImmRscHandles[newId] = nil
-	return newId
+func indexPLocal[T any](base unsafe.Pointer, i int32) *pLocalPad[T] {
+	return (*pLocalPad[T])(unsafe.Pointer(uintptr(base) + uintptr(i)*unsafe.Sizeof(pLocalPad[T]{})))
 }
 
-var latestImmRscHandle *ImmRscHandle = newImmRscHandle(nil)
-var latestImmRscHandleMutex sync.Mutex
+// pin pins the calling goroutine to its P and returns that P's cache slot. Callers must call runtime_procUnpin
+// once they are done touching the slot.
+func (p *MVPtr[T]) pin() (*pLocalPad[T], int32) {
+	pid := runtime_procPin()
+	s := atomic.LoadInt32(&p.pLocalsSize)
+	if int32(pid) < s {
+		return indexPLocal[T](atomic.LoadPointer(&p.pLocals), int32(pid)), int32(pid)
+	}
+	return p.pinSlow()
+}
 
+func (p *MVPtr[T]) pinSlow() (*pLocalPad[T], int32) {
+	// Retry under pLocalsMu: unpin first since pLocalsMu is a regular mutex and we must not block while pinned.
+	runtime_procUnpin()
+	p.pLocalsMu.Lock()
+	defer p.pLocalsMu.Unlock()
 
-type ImmRscHandleWrap struct {
-	*ImmRscHandle
-	mightPaasToOtherGoroutine bool
+	pid := runtime_procPin()
+	s := int32(runtime.GOMAXPROCS(0))
+	if int32(pid) < atomic.LoadInt32(&p.pLocalsSize) {
+		return indexPLocal[T](atomic.LoadPointer(&p.pLocals), int32(pid)), int32(pid)
+	}
+	locals := make([]pLocalPad[T], s)
+	atomic.StorePointer(&p.pLocals, unsafe.Pointer(&locals[0]))
+	atomic.StoreInt32(&p.pLocalsSize, s)
+	return &locals[pid], int32(pid)
 }
 
+func atomicSwapImmRscHandle[T any](addr **immRscHandle[T], new *immRscHandle[T]) *immRscHandle[T] {
+	return (*immRscHandle[T])(atomic.SwapPointer((*unsafe.Pointer)(unsafe.Pointer(addr)), unsafe.Pointer(new)))
+}
+func atomicCmpAndSwapImmRscHandle[T any](addr **immRscHandle[T], old, new *immRscHandle[T]) bool {
+	return atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(addr)), unsafe.Pointer(old), unsafe.Pointer(new))
+}
 
-// If `mightShare`, caller is allowed to call Ref() to make a copy of the ownership
-// and then paas the copy to other goroutines. If caller uses in this way, then it must use Unref() to
-// release the ownership for evey copy.
+// Load returns a Snapshot of the current version of T. The caller must call Release() on it exactly once.
 //
-// Otherwise, caller can not
-// 1. call Ref()
-// 2. call GetResouce() again before DoneUsingResource()
-// 3. share the handle with other goroutines
-// Caller must call DoneUsingResource() to release the ownership
-//
-// The first way is a user-friendly one but it is slower.
-func GetResouce(gID int32, mightShare bool) *ImmRscHandle {
-	if gID < 0 || gID > maxGID {
-		panic("unallocated goroutine ID")
-	}
+// This is also why we have eventual consistency.
+// Assuming Store() is called once and called simultaneously with this func.
+// If this goroutine swaps before the writer, this func returns the second latest version.
+// Otherwise, this func returns the latest version, unless it is the first Load() on this P since the Store()
+// and finds the version this P had cached (normally the second latest) in the retire slot.
+func (p *MVPtr[T]) Load() *Snapshot[T] {
+	// l is the slot for the P we are currently pinned to. It is shared between whichever goroutine is reading
+	// through this P and the writer(s) (there can be more than one writer at a time), so this is a
+	// reader-writer conflict resolved by swap instructions: the winner sees the original value while the loser
+	// sees the special mark (kInuse or nil).
+	l, _ := p.pin()
+	local := atomicSwapImmRscHandle(&l.current, p.kInuse)
+	runtime_procUnpin()
 
-	// gLocalImmRscHandles[gID] is shared between this goroutine and the writer(there can be one writer only at any given time)
-	// so this is a one-reader-one-writer conflict. We let them compete by conducting swap instruction so that the winer sees
-	// the original value while the loser sees the special mark(kInuse or nil).
-	//
-	// This is also why we have eventual consistency.
-	// Assuming UpdateResouce() is called once and called simultaneously with this func.
-	// If this goroutine swaps before the writer, this func returns the second latest version.
-	// Otherwise, this func returns the latest version.
-
-	var res *ImmRscHandle
-	local := atomicSwapGLocalImmRscHandle(gID, kInuse) // A
-	if local == nil { // This is the first time for the current goroutine to call this func or `globalResouce` has been updated
-		latestImmRscHandleMutex.Lock()
-		res = latestImmRscHandle.Ref() // Ref() can only be called with mutex held, otherwise, it might race with Unref()
-		latestImmRscHandleMutex.Unlock()
-	} else if local == kInuse {
-		panic("gLocalImmRscHandles[" + fmt.Sprint(gID) + "] must be either a valid ptr or a nil set by writer")
-	} else {
+	var res *immRscHandle[T]
+	fromRetire := false
+	if local != nil && local != p.kInuse {
 		res = local
+	} else {
+		// Miss on the local slot (nil, or kInuse — a collision with another goroutine sharing this P across its
+		// own Load/Release span, harmless, treated the same as a miss). Before falling all the way back to the
+		// root, probe this P's retire slot: Store() pushes the handle it just superseded there, so it's still a
+		// valid (and Ref()'d) handle good for one more cycle.
+		if retired := atomicSwapImmRscHandle(&l.retire, nil); retired != nil {
+			res = retired
+			fromRetire = true
+		} else {
+			// Root-miss path: there's no per-P slot to atomically hand off an existing ref from, so this takes
+			// its own ref directly off latest. Unlike RcuRead, this doesn't register against the RCU epoch
+			// machinery (see pEpochPad.active): RcuRead hands out a value with no ref at all and needs the grace
+			// period to stand in for one, whereas this call ends up with its own Ref()'d handle, protected by the
+			// ordinary refcount regardless of whether anyone ever calls RcuQuiescent (see the note on rootRetire).
+			res = p.latest.Load().Ref()
+		}
 	}
 
-	if mightShare {
-		// Make a copy and then return to local store, otherwise we have to lock the mutex to
-		// read the global `latestImmRscPtr` at the next call
-		if !atomicCmpAndSwapGLocalImmRscHandles(gID, kInuse, res.Ref()) {
-			// Failed due to the local ptr(gLocalImmRscHandles[gID]) has been changed to nil by writer since A,
-			// then we rather than the next writer are responsible for Unref()
-			res.Unref()
-		}
-		// else the next writer will Unref() when it invalidates our local ptr
+	// Hand a fresh copy back to the cache immediately so the next Load() on this P has a chance at the
+	// lock-free path too. The old package-level API traded this extra CAS away on its non-shareable fast path,
+	// at the cost of requiring callers to promise not to call GetResouce twice before DoneUsingResource — a
+	// sharp edge not worth keeping now that MVPtr instances are meant to be used casually from arbitrary call
+	// sites.
+	// A handle taken from the retire slot is not handed back: it was cached before the last Store(), and putting
+	// it into current would let this P keep serving it across later Stores. current is reset to nil instead, so
+	// the next Load() on this P reads latest.
+	var back *immRscHandle[T]
+	if !fromRetire {
+		back = res.Ref()
 	}
+	l2, _ := p.pin()
+	ok := atomicCmpAndSwapImmRscHandle(&l2.current, p.kInuse, back)
+	runtime_procUnpin()
+	if !ok && back != nil {
+		// Failed due to the local ptr having been changed (by a writer, or claimed by another goroutine sharing
+		// this P) since we last pinned, so we rather than the writer are responsible for this Ref().
+		res.Unref()
+	}
+
+	return &Snapshot[T]{h: res}
+}
 
-	return res
+// RcuRead returns the current version of T directly, with none of the bookkeeping Load does: no per-P cache slot
+// is touched and no refcount is bumped. It is not a bare pointer load, though: it pins to the current P and
+// atomically marks that P's epoch slot active (see below) before the atomic load of latest, and the first call
+// on a P may allocate the epoch array under rcuEpochsMu. No atomic read-modify-write is done on the read side.
+//
+// The value returned stays valid until the calling goroutine calls RcuQuiescent — there is no Release step per
+// read. A caller that does several RcuReads in a row only needs to call RcuQuiescent once, after the last one,
+// to declare that it is no longer holding on to anything it read. A caller that never calls RcuQuiescent again
+// after reading will indefinitely delay the deleter for every subsequent Store on this MVPtr (see
+// waitForQuiescence): unlike Load/Release, there is no per-read accounting to fall back on if the contract is
+// broken.
+//
+// RcuRead and RcuQuiescent are meant to be used instead of Load/Release, not mixed with them on hot paths: they
+// are a different, looser safety discipline layered on the same Store.
+//
+// RcuRead marks the calling goroutine's P as active in this MVPtr's grace period (see pEpochPad.active) before
+// it reads anything: a P that never calls RcuRead or RcuQuiescent is not a participant at all and can't stall
+// waitForQuiescence, but one that does participate has to be visible to it for the whole time a read might be
+// in flight, which is exactly what setting active does here before the Load below.
+func (p *MVPtr[T]) RcuRead() T {
+	ep, _ := p.pinEpoch()
+	atomic.StoreUint32(&ep.active, 1)
+	runtime_procUnpin()
+	return p.latest.Load().value
 }
 
-func DoneUsingResource(gID int32, gotFromLocal *ImmRscHandle) {
-	if !atomicCmpAndSwapGLocalImmRscHandles(gID, kInuse, gotFromLocal) {
-		gotFromLocal.Unref()
+// RcuQuiescent declares that the calling goroutine holds no references obtained via RcuRead. See RcuRead for
+// the full contract.
+func (p *MVPtr[T]) RcuQuiescent() {
+	l, _ := p.pinEpoch()
+	// Store epoch before active: a waiter that observes active == 1 must also observe an epoch at least this
+	// fresh, and writing epoch first (the two are never read in the other order) is what guarantees that.
+	atomic.StoreUint64(&l.epoch, atomic.LoadUint64(&p.rcuGeneration))
+	atomic.StoreUint32(&l.active, 1)
+	runtime_procUnpin()
+}
+
+// pEpochPad is a per-P slot in the RCU grace-period machinery. active distinguishes "this P has never called
+// RcuRead or RcuQuiescent on this MVPtr" (0: vacuously quiescent, skipped by waitForQuiescence — it can't be
+// holding a stale read because it has never taken one) from "this P has participated" (1: its epoch must catch
+// up to a generation before waitForQuiescence(gen) can consider it quiescent). Without this, an all-GOMAXPROCS
+// array allocated the first time any P reads (see pinEpochSlow) would leave every P that has never touched this
+// MVPtr stuck at epoch 0 forever, which waitForQuiescence would then wait on indefinitely.
+type pEpochPad struct {
+	epoch  uint64
+	active uint32
+	pad    [116]byte // see the note on pLocalPad; 128 bytes minus one uint64 and one uint32
+}
+
+func indexEpoch(base unsafe.Pointer, i int32) *pEpochPad {
+	return (*pEpochPad)(unsafe.Pointer(uintptr(base) + uintptr(i)*unsafe.Sizeof(pEpochPad{})))
+}
+
+func (p *MVPtr[T]) pinEpoch() (*pEpochPad, int32) {
+	pid := runtime_procPin()
+	s := atomic.LoadInt32(&p.rcuEpochsSize)
+	if int32(pid) < s {
+		return indexEpoch(atomic.LoadPointer(&p.rcuEpochs), int32(pid)), int32(pid)
 	}
-	// else the next writer will Unref() when it invalidates our local ptr
+	return p.pinEpochSlow()
 }
 
-// can be called by any goroutine without any synchronization
-func UpdateResouce(r ImmutableResource) {
-	latestImmRscHandleMutex.Lock()
+func (p *MVPtr[T]) pinEpochSlow() (*pEpochPad, int32) {
+	runtime_procUnpin()
+	p.rcuEpochsMu.Lock()
+	defer p.rcuEpochsMu.Unlock()
 
-	old := latestImmRscHandle
-	latestImmRscHandle = newImmRscHandle(r) // overwritten with mutex held and before invalidate local ptrs
+	pid := runtime_procPin()
+	s := int32(runtime.GOMAXPROCS(0))
+	if int32(pid) < atomic.LoadInt32(&p.rcuEpochsSize) {
+		return indexEpoch(atomic.LoadPointer(&p.rcuEpochs), int32(pid)), int32(pid)
+	}
+	epochs := make([]pEpochPad, s)
+	atomic.StorePointer(&p.rcuEpochs, unsafe.Pointer(&epochs[0]))
+	atomic.StoreInt32(&p.rcuEpochsSize, s)
+	return &epochs[pid], int32(pid)
+}
 
-	for i := 0; i <= int(maxGID); i ++ {
-		local := atomicSwapGLocalImmRscHandle(int32(i), nil)
-		if local != kInuse && local != nil {
-			if old != local {
-				panic("gLocalImmRscHandles[" + fmt.Sprint(i) + "] does not hold the latest version")
+// waitForQuiescence blocks until every P that has ever called RcuRead or RcuQuiescent on this MVPtr (see
+// pEpochPad.active) has an epoch that has caught up to generation gen, i.e. until no goroutine can still be
+// holding a T read via RcuRead from before the Store that produced gen. Ps that have never participated are
+// skipped entirely: rcuEpochs is allocated to cover all of GOMAXPROCS the first time anyone reads (see
+// pinEpochSlow), so without the active check an unrelated, permanently idle P would sit at epoch 0 forever and
+// this would never return. A P that did participate and then stopped calling RcuQuiescent is, by contrast,
+// deliberately still tracked and correctly blocks this forever, per the contract documented on RcuRead.
+func (p *MVPtr[T]) waitForQuiescence(gen uint64) {
+	for {
+		n := atomic.LoadInt32(&p.rcuEpochsSize)
+		base := atomic.LoadPointer(&p.rcuEpochs)
+		caughtUp := true
+		for i := int32(0); i < n; i++ {
+			e := indexEpoch(base, i)
+			if atomic.LoadUint32(&e.active) == 0 {
+				continue
 			}
-			if local.Unref() { // This could not be the last reference, see the last line of this function
-				panic("bad refcnt")
+			if atomic.LoadUint64(&e.epoch) < gen {
+				caughtUp = false
+				break
 			}
 		}
+		if caughtUp {
+			return
+		}
+		runtime.Gosched()
 	}
+}
+
+// Store publishes a new version of T. deleter, if non-nil, is called exactly once, once the last Snapshot
+// referencing v is released (Load/Release mode) and every reader has passed through a quiescent state since
+// the Store that superseded v (RcuRead/RcuQuiescent mode) — both conditions apply regardless of which mode is actually in use,
+// since Store has no way of knowing. Can be called by any goroutine without any external synchronization,
+// including concurrently with other Store calls.
+func (p *MVPtr[T]) Store(v T, deleter func(T)) {
+	gen := atomic.AddUint64(&p.rcuGeneration, 1)
 
-	latestImmRscHandleMutex.Unlock()
+	newHandle := newImmRscHandle(v, deleter)
+	old := p.latest.Swap(newHandle) // lock-free: readers always Load() a consistent, valid pointer
 
-	// this might call Resouce::Delete(), which might be time-consuming
-	// therefore we call it here without mutex held
-	old.Unref()
+	// old, if any, is superseded as of gen, not as of whatever generation it was itself published under: a
+	// reader that already quiesced against an earlier generation and only then RcuRead old is exactly who this
+	// wait has to account for, so it must be keyed off the generation bumped on the Store that retires old, not
+	// the one bumped on the Store that created it — wrapping old's deleter here, rather than at its own creation
+	// a cycle ago, is what makes that possible. This mutation is race-free: old's implicit refcnt=1 from its own
+	// creation is still outstanding until the Unref calls below (or a future Store's) run, so no concurrent
+	// Release() can observe old.deleter mid-write.
+	if old != nil && old.deleter != nil {
+		userDeleter := old.deleter
+		old.deleter = func(val T) {
+			// Run off the caller's goroutine: waitForQuiescence is unbounded, and whatever triggers it (a
+			// Snapshot.Release, or this very Store call's own retire sweep below) must not block on it.
+			go func() {
+				p.waitForQuiescence(gen)
+				userDeleter(val)
+			}()
+		}
+	}
+
+	n := atomic.LoadInt32(&p.pLocalsSize)
+	base := atomic.LoadPointer(&p.pLocals)
+	for i := int32(0); i < n; i++ {
+		l := indexPLocal[T](base, i)
+		cur := atomicSwapImmRscHandle(&l.current, nil)
+		var newRetire *immRscHandle[T]
+		if cur != p.kInuse && cur != nil {
+			// Push what this P had cached into its retire slot instead of unreffing it directly, giving any
+			// reader that picks it back up via the retire-slot fast path one more cycle of life.
+			newRetire = cur
+		}
+		// Age the retire slot out unconditionally, even on a P that had nothing live in `current` (cur == nil or
+		// kInuse): a P idle across several Store()s must not let its victim sit there forever, or a reader that
+		// later misses onto it is handed an arbitrarily stale version with no writer ever around to clear it —
+		// and that old version's deleter would never run. Whatever was already sitting in the retire slot has
+		// survived a full cycle under the same rule and can be released now. Unref() returning true here just
+		// means this was the last reference and the deleter ran, which is the expected outcome, not an error —
+		// unlike Ref()/Unref()'s own internal panics, which guard against refcnt going negative.
+		if stale := atomicSwapImmRscHandle(&l.retire, newRetire); stale != nil {
+			stale.Unref()
+		}
+	}
+
+	// `old` is unreachable from latest the instant the Swap above completes, so no future Load() returns it; a
+	// reader that Load()'d it a moment earlier but hasn't called Ref() yet is the remaining hazard, and
+	// rootRetire gives it a full extra cycle to do so before we drop our own reference (see the note on
+	// rootRetire).
+	if prev := p.rootRetire.Swap(old); prev != nil {
+		// this might trigger prev's deleter (which then runs on its own goroutine, see above), so we do it last
+		prev.Unref()
+	}
 }
 
 // unexported stuffs:
 
-func newImmRscHandle(rsc ImmutableResource) *ImmRscHandle {
-	return &ImmRscHandle{
-		refcnt: 1,
-		R: rsc,
+func newImmRscHandle[T any](v T, deleter func(T)) *immRscHandle[T] {
+	return &immRscHandle[T]{
+		refcnt:  1,
+		value:   v,
+		deleter: deleter,
 	}
 }
 
-// ImmRscHandle must be allocated in heap and can not be copied using = operator
-type ImmRscHandle struct {
-	refcnt int32
-	R ImmutableResource
+// immRscHandle must be allocated in heap and can not be copied using = operator
+type immRscHandle[T any] struct {
+	refcnt  int32
+	value   T
+	deleter func(T)
 }
 
-// The goroutine create this ImmRscHandle is the first owner of the underlying resource
+// The goroutine create this immRscHandle is the first owner of the underlying value
 // Owner is allowed to call Ref() without any external synchronization
-func (p *ImmRscHandle) Ref() *ImmRscHandle {
-	if atomic.AddInt32(&p.refcnt, 1) <= 0 {
+func (h *immRscHandle[T]) Ref() *immRscHandle[T] {
+	if atomic.AddInt32(&h.refcnt, 1) <= 0 {
 		panic("bad refcnt")
 	}
-	return p
+	return h
 }
-func (p *ImmRscHandle) Unref() (deleted bool) {
-	after := atomic.AddInt32(&p.refcnt, -1)
+func (h *immRscHandle[T]) Unref() (deleted bool) {
+	after := atomic.AddInt32(&h.refcnt, -1)
 	if after == 0 {
-		p.R.Delete()
+		if h.deleter != nil {
+			h.deleter(h.value)
+		}
 		return true
 	} else if after < 0 {
 		panic("bad refcnt")
 	}
 
 	return false
-}
\ No newline at end of file
+}
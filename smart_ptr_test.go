@@ -0,0 +1,79 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReclaimUnderMixedModes publishes a run of versions on one MVPtr while both Load/Release readers and
+// RcuRead/RcuQuiescent readers are concurrently hammering it across multiple Ps, then asserts every superseded
+// version's deleter eventually runs. A handful of trailing no-deleter Stores follow the real versions so that the
+// last of them gets retired too (a version's deleter only becomes eligible once a later Store supersedes it).
+func TestReclaimUnderMixedModes(t *testing.T) {
+	prevProcs := runtime.GOMAXPROCS(4)
+	defer runtime.GOMAXPROCS(prevProcs)
+
+	const versions = 6
+	const flush = 3
+	const readers = 4
+
+	p := NewMVPtr[int]()
+	deleted := make([]int32, versions+1)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2 * readers)
+	for i := 0; i < readers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					s := p.Load()
+					_ = s.Value()
+					s.Release()
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					_ = p.RcuRead()
+					p.RcuQuiescent()
+				}
+			}
+		}()
+	}
+
+	for i := 1; i <= versions+flush; i++ {
+		i := i
+		if i <= versions {
+			p.Store(i, func(int) { atomic.StoreInt32(&deleted[i], 1) })
+		} else {
+			p.Store(i, nil)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 1; i <= versions; i++ {
+		for atomic.LoadInt32(&deleted[i]) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("deleter for version %d never ran", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+}